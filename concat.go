@@ -5,14 +5,62 @@ package main
 
 import (
 	"bufio"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/peterh/liner"
+)
+
+// Sentinel errors identify a failure's kind; EvalError wraps one with the source position
+// it happened at, so callers can both pattern-match (errors.Is) and show the user where
+// things went wrong.
+var (
+	ErrStackUnderflow  = errors.New("stack underflow")
+	ErrStackOverflow   = errors.New("stack overflow")
+	ErrDivideByZero    = errors.New("divide by zero")
+	ErrUnknownWord     = errors.New("unknown word")
+	ErrTypeMismatch    = errors.New("type mismatch")
+	ErrUnterminated    = errors.New("unterminated block")
+	ErrUnexpectedToken = errors.New("unexpected token")
 )
 
+// EvalError is the error type returned by Eval and everything it calls: a sentinel error
+// plus the position in the source that triggered it.
+type EvalError struct {
+	Pos Pos
+	Err error
+}
+
+func (e *EvalError) Error() string { return fmt.Sprintf("%v: %v", e.Pos, e.Err) }
+func (e *EvalError) Unwrap() error { return e.Err }
+
+// Pos is a source position, modelled on go/token.Position: enough to point a user (or an
+// error message) back at the exact spot a token came from.
+type Pos struct {
+	Filename string
+	Line     int
+	Column   int
+	Offset   int
+}
+
+func (p Pos) String() string {
+	if p.Filename != "" {
+		return fmt.Sprintf("%s:%d:%d", p.Filename, p.Line, p.Column)
+	}
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
 type token struct {
 	typ tokenType
 	val string
+	pos Pos
 }
 
 type tokenType int
@@ -22,208 +70,1020 @@ func (t token) String() string {
 }
 
 const (
-	tokenUnknown  tokenType = iota // don't recognise the input
-	tokenInt                       // integer
-	tokenPlus                      // +
-	tokenMinus                     // -
-	tokenMultiply                  // *
-	tokenDivide                    // /
-	tokenDot                       // dot - pop and print
-	tokenPS                        // .S print the stack
-	tokenEOL                       // end of line
+	tokenUnknown   tokenType = iota // don't recognise the input
+	tokenInt                        // integer
+	tokenFloat                      // floating point, e.g. 3.14
+	tokenString                     // "..." string literal
+	tokenTrue                       // true
+	tokenFalse                      // false
+	tokenPlus                       // +
+	tokenMinus                      // -
+	tokenMultiply                   // *
+	tokenDivide                     // /
+	tokenEq                         // =
+	tokenLt                         // <
+	tokenGt                         // >
+	tokenAnd                        // and
+	tokenOr                         // or
+	tokenNot                        // not
+	tokenDup                        // dup
+	tokenDrop                       // drop
+	tokenSwap                       // swap
+	tokenOver                       // over
+	tokenRot                        // rot
+	tokenDot                        // dot - pop and print
+	tokenPS                         // .S print the stack
+	tokenColon                      // : - start a word definition
+	tokenSemicolon                  // ; - end a word definition
+	tokenWord                       // a name, either a user-defined word or an unknown one
+	tokenIf                         // IF
+	tokenElse                       // ELSE
+	tokenThen                       // THEN
+	tokenBegin                      // BEGIN
+	tokenUntil                      // UNTIL
+	tokenDo                         // DO
+	tokenLoop                       // LOOP
+	tokenI                          // I - index of the innermost DO...LOOP
+	tokenJ                          // J - index of the next DO...LOOP out
+	tokenEOL                        // end of line
 )
 
+// keywords maps the reserved control-flow, definition and literal words to their token
+// types. Anything else scanned as a word falls back to tokenWord and is looked up in the
+// dictionary.
+var keywords = map[string]tokenType{
+	"IF":    tokenIf,
+	"ELSE":  tokenElse,
+	"THEN":  tokenThen,
+	"BEGIN": tokenBegin,
+	"UNTIL": tokenUntil,
+	"DO":    tokenDo,
+	"LOOP":  tokenLoop,
+	"I":     tokenI,
+	"J":     tokenJ,
+	"true":  tokenTrue,
+	"false": tokenFalse,
+	"and":   tokenAnd,
+	"or":    tokenOr,
+	"not":   tokenNot,
+	"dup":   tokenDup,
+	"drop":  tokenDrop,
+	"swap":  tokenSwap,
+	"over":  tokenOver,
+	"rot":   tokenRot,
+}
+
+// lexer scans one line of source at a time, decoding runes rather than indexing bytes, so
+// that word names can contain non-ASCII characters. It tracks enough of the surrounding
+// file to stamp every token with a Pos.
 type lexer struct {
-	line  string
-	start int
-	pos   int
+	filename string
+	line     string
+	lineNo   int
+	offset   int // byte offset of the start of line within the whole input
+
+	start    int // byte offset of the current token within line
+	startCol int // column (in runes) of the current token
+	pos      int // byte offset of the scan head within line
+	col      int // column (in runes) of the scan head
 }
 
-func (lxr *lexer) init(text string) {
+// init (re)points the lexer at a new line. offset is the byte offset of this line's first
+// character within the whole input, used to populate Pos.Offset.
+func (lxr *lexer) init(filename string, lineNo, offset int, text string) {
+	lxr.filename = filename
 	lxr.line = text
+	lxr.lineNo = lineNo
+	lxr.offset = offset
 	lxr.start = 0
 	lxr.pos = 0
+	lxr.col = 1
+}
+
+// peekRune returns the rune at the scan head and its width in bytes, or (0, 0) at end of line.
+func (lxr *lexer) peekRune() (rune, int) {
+	if lxr.pos >= len(lxr.line) {
+		return 0, 0
+	}
+	return utf8.DecodeRuneInString(lxr.line[lxr.pos:])
+}
+
+// advance moves the scan head past one rune of the given width.
+func (lxr *lexer) advance(width int) {
+	lxr.pos += width
+	lxr.col++
+}
+
+func (lxr *lexer) tokenPos() Pos {
+	return Pos{Filename: lxr.filename, Line: lxr.lineNo, Column: lxr.startCol, Offset: lxr.offset + lxr.start}
 }
 
 func (lxr *lexer) next() token {
 	lxr.skipWhiteSpace()
 	if lxr.pos >= len(lxr.line) {
-		return token{typ: tokenEOL}
+		return token{typ: tokenEOL, pos: lxr.tokenPos()}
 	}
-	ch := lxr.line[lxr.pos]
-	sch := string(ch)
+	lxr.start = lxr.pos
+	lxr.startCol = lxr.col
+	ch, width := lxr.peekRune()
+	pos := lxr.tokenPos()
 	switch {
 	case ch == '+':
-		lxr.pos++
-		return token{typ: tokenPlus, val: sch}
+		lxr.advance(width)
+		return token{typ: tokenPlus, val: string(ch), pos: pos}
 	case ch == '-':
-		lxr.pos++
-		return token{typ: tokenMinus, val: sch}
+		lxr.advance(width)
+		return token{typ: tokenMinus, val: string(ch), pos: pos}
 	case ch == '*':
-		lxr.pos++
-		return token{typ: tokenMultiply, val: sch}
+		lxr.advance(width)
+		return token{typ: tokenMultiply, val: string(ch), pos: pos}
 	case ch == '/':
-		lxr.pos++
-		return token{typ: tokenDivide, val: sch}
+		lxr.advance(width)
+		return token{typ: tokenDivide, val: string(ch), pos: pos}
+	case ch == '=':
+		lxr.advance(width)
+		return token{typ: tokenEq, val: string(ch), pos: pos}
+	case ch == '<':
+		lxr.advance(width)
+		return token{typ: tokenLt, val: string(ch), pos: pos}
+	case ch == '>':
+		lxr.advance(width)
+		return token{typ: tokenGt, val: string(ch), pos: pos}
+	case ch == ':':
+		lxr.advance(width)
+		return token{typ: tokenColon, val: string(ch), pos: pos}
+	case ch == ';':
+		lxr.advance(width)
+		return token{typ: tokenSemicolon, val: string(ch), pos: pos}
+	case ch == '"':
+		lxr.advance(width)
+		contentStart := lxr.pos
+		for {
+			r, w := lxr.peekRune()
+			if w == 0 || r == '"' {
+				break
+			}
+			lxr.advance(w)
+		}
+		str := lxr.line[contentStart:lxr.pos]
+		if _, w := lxr.peekRune(); w != 0 {
+			lxr.advance(w) // consume the closing quote
+		}
+		return token{typ: tokenString, val: str, pos: pos}
 	case ch == '.':
-		if lxr.peek() == 'S' {
-			lxr.pos += 2
-			return token{typ: tokenPS}
-		} else {
-			lxr.pos++
-			return token{typ: tokenDot, val: sch}
+		if next, nextWidth := lxr.peekAt(width); next == 'S' {
+			lxr.advance(width)
+			lxr.advance(nextWidth)
+			return token{typ: tokenPS, pos: pos}
 		}
+		lxr.advance(width)
+		return token{typ: tokenDot, val: string(ch), pos: pos}
 	case isDigit(ch):
-		lxr.start = lxr.pos
 		for {
-			lxr.pos++
-			if lxr.pos >= len(lxr.line) || !isDigit(lxr.line[lxr.pos]) {
-				lxr.pos--
+			r, w := lxr.peekRune()
+			if w == 0 || !isDigit(r) {
 				break
 			}
+			lxr.advance(w)
+		}
+		if dot, dotWidth := lxr.peekRune(); dot == '.' {
+			if frac, _ := lxr.peekAt(dotWidth); isDigit(frac) {
+				lxr.advance(dotWidth)
+				for {
+					r, w := lxr.peekRune()
+					if w == 0 || !isDigit(r) {
+						break
+					}
+					lxr.advance(w)
+				}
+				return token{typ: tokenFloat, val: lxr.line[lxr.start:lxr.pos], pos: pos}
+			}
 		}
-		lxr.pos++
-		return token{typ: tokenInt, val: lxr.line[lxr.start:lxr.pos]}
+		return token{typ: tokenInt, val: lxr.line[lxr.start:lxr.pos], pos: pos}
 	default:
-		lxr.start = lxr.pos
 		for {
-			lxr.pos++
-			if lxr.pos >= len(lxr.line) || isWhiteSpace(lxr.line[lxr.pos]) {
-				lxr.pos--
+			r, w := lxr.peekRune()
+			if w == 0 || isWhiteSpace(r) {
 				break
 			}
+			lxr.advance(w)
 		}
-		lxr.pos++
-		return token{typ: tokenUnknown, val: lxr.line[lxr.start:lxr.pos]}
+		word := lxr.line[lxr.start:lxr.pos]
+		if typ, ok := keywords[word]; ok {
+			return token{typ: typ, val: word, pos: pos}
+		}
+		return token{typ: tokenWord, val: word, pos: pos}
+	}
+}
+
+// peekAt looks one rune past the scan head plus the given byte width, used for the ".S"
+// digraph and for distinguishing "3" from "3.14".
+func (lxr *lexer) peekAt(width int) (rune, int) {
+	p := lxr.pos + width
+	if p >= len(lxr.line) {
+		return 0, 0
 	}
+	return utf8.DecodeRuneInString(lxr.line[p:])
 }
 
 func (lxr *lexer) skipWhiteSpace() {
 	for {
-		if lxr.pos < len(lxr.line) && lxr.line[lxr.pos] == ' ' {
-			lxr.pos++
-		} else {
+		r, w := lxr.peekRune()
+		if w == 0 || !isWhiteSpace(r) {
 			break
 		}
+		lxr.advance(w)
 	}
 }
 
-func (lxr *lexer) peek() byte {
-	if lxr.pos < len(lxr.line)-1 {
-		return lxr.line[lxr.pos+1]
-	} else {
-		return ' '
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+func isWhiteSpace(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// valueKind tags what a value on the stack actually holds.
+type valueKind int
+
+const (
+	kindInt valueKind = iota
+	kindFloat
+	kindBool
+	kindString
+)
+
+func (k valueKind) String() string {
+	switch k {
+	case kindInt:
+		return "Int"
+	case kindFloat:
+		return "Float"
+	case kindBool:
+		return "Bool"
+	case kindString:
+		return "String"
+	default:
+		return "Unknown"
 	}
 }
 
-func isDigit(n byte) bool {
-	if n >= '0' && n <= '9' {
-		return true
-	} else {
-		return false
+// value is the stack payload: a tagged union of the types concat understands, rather than
+// a string that every primitive has to re-parse.
+type value struct {
+	kind valueKind
+	i    int
+	f    float64
+	b    bool
+	s    string
+}
+
+func (v value) String() string {
+	switch v.kind {
+	case kindInt:
+		return strconv.Itoa(v.i)
+	case kindFloat:
+		return strconv.FormatFloat(v.f, 'g', -1, 64)
+	case kindBool:
+		return strconv.FormatBool(v.b)
+	case kindString:
+		return v.s
+	default:
+		return "?"
 	}
 }
 
-func isWhiteSpace(ch byte) bool {
-	if ch == ' ' || ch == '\t' {
-		return true
-	} else {
-		return false
+// asFloat promotes an Int to a Float; it errors for any other kind, since only numbers
+// participate in the int-to-float promotion used by arithmetic and ordering.
+func (v value) asFloat() (float64, error) {
+	switch v.kind {
+	case kindInt:
+		return float64(v.i), nil
+	case kindFloat:
+		return v.f, nil
+	default:
+		return 0, fmt.Errorf("%w: %v is not a number", ErrTypeMismatch, v)
 	}
 }
 
-const stackSize = 1000
+// defaultMaxDepth is the stack depth newInterp allows before push reports an overflow.
+const defaultMaxDepth = 1000
 
-// This is an old-fashioned fixed-length stack which avoids the usual incessant memory alloc/dealloc.
-// Note that I even waste the first (zeroth) entry so I can use top = 0 to indicate empty.
+// stack is a slice-backed LIFO of values. Unlike the fixed-array stack this replaces, push
+// and pop are O(1) via append/truncate rather than a linear scan for a free frame.
+// maxDepth bounds how far it can grow. Every operation that can fail (an empty stack, a
+// full one) reports an *EvalError instead of panicking, so Eval can hand the failure back
+// to its caller without anyone needing recover().
 type stack struct {
-	top   uint
-	frame [stackSize + 1]struct {
-		used    bool
-		payload token
-		prev    uint
+	data     []value
+	maxDepth int
+}
+
+func (s *stack) push(v value, at Pos) error {
+	if s.maxDepth > 0 && len(s.data) >= s.maxDepth {
+		return &EvalError{at, ErrStackOverflow}
 	}
+	s.data = append(s.data, v)
+	return nil
 }
 
-func (s *stack) push(t token) {
-	for i := 1; i <= stackSize; i++ {
-		if !s.frame[i].used {
-			s.frame[i].used = true
-			s.frame[i].payload = t
-			s.frame[i].prev = s.top
-			s.top = uint(i)
-			return
-		}
+func (s *stack) pop(at Pos) (value, error) {
+	if len(s.data) == 0 {
+		return value{}, &EvalError{at, ErrStackUnderflow}
+	}
+	v := s.data[len(s.data)-1]
+	s.data = s.data[:len(s.data)-1]
+	return v, nil
+}
+
+func (s *stack) peek(at Pos) (value, error) {
+	if len(s.data) == 0 {
+		return value{}, &EvalError{at, ErrStackUnderflow}
+	}
+	return s.data[len(s.data)-1], nil
+}
+
+// peekN is like peek but looks depth entries below the top (0 is the top itself), used for
+// I and J to reach into the return stack's nested DO...LOOP indices.
+func (s *stack) peekN(depth int, at Pos) (value, error) {
+	n := len(s.data)
+	if depth < 0 || depth >= n {
+		return value{}, &EvalError{at, ErrStackUnderflow}
+	}
+	return s.data[n-1-depth], nil
+}
+
+func (s *stack) dup(at Pos) error {
+	v, err := s.peek(at)
+	if err != nil {
+		return err
 	}
-	panic(fmt.Errorf("Stack overflow"))
+	return s.push(v, at)
+}
+
+func (s *stack) drop(at Pos) error {
+	_, err := s.pop(at)
+	return err
 }
 
-func (s *stack) pop() token {
-	if s.top == 0 {
-		panic(fmt.Errorf("Stack underflow"))
+func (s *stack) swap(at Pos) error {
+	n := len(s.data)
+	if n < 2 {
+		return &EvalError{at, ErrStackUnderflow}
 	}
-	ret := s.frame[s.top].payload
-	s.frame[s.top].used = false
-	s.top = s.frame[s.top].prev
-	return ret
+	s.data[n-1], s.data[n-2] = s.data[n-2], s.data[n-1]
+	return nil
+}
+
+func (s *stack) over(at Pos) error {
+	n := len(s.data)
+	if n < 2 {
+		return &EvalError{at, ErrStackUnderflow}
+	}
+	return s.push(s.data[n-2], at)
+}
+
+func (s *stack) rot(at Pos) error {
+	n := len(s.data)
+	if n < 3 {
+		return &EvalError{at, ErrStackUnderflow}
+	}
+	s.data[n-3], s.data[n-2], s.data[n-1] = s.data[n-2], s.data[n-1], s.data[n-3]
+	return nil
 }
 
 func (s *stack) prin() {
-	fr := s.top
-	for fr != 0 {
-		fmt.Printf("%v %v %v\n", fr, s.frame[fr].payload.typ, s.frame[fr].payload.val)
-		fr = s.frame[fr].prev
+	for i := len(s.data) - 1; i >= 0; i-- {
+		fmt.Printf("%v %v %v\n", i+1, s.data[i].kind, s.data[i])
 	}
 }
 
-func main() {
-	ch := make(chan token)
-	go getTokens(ch)
+// numOp is a dyadic numeric operator with both an Int and a Float implementation, so that
+// arithmetic can follow the usual int-to-float promotion rule: if either operand is a
+// Float, the whole operation is done in Float.
+type numOp struct {
+	intOp   func(int, int) int
+	floatOp func(float64, float64) float64
+}
+
+// interp holds all the state needed to run a stream of tokens: the data stack, the return
+// stack (used for word-call nesting and DO...LOOP indices), the dictionary of user-defined
+// words, and the in-progress state of a `: name ... ;` definition.
+type interp struct {
+	stak  stack
+	rstak stack
+	fMap  map[tokenType]numOp
+
+	dictionary map[string][]token
+
+	compiling   bool
+	compileName string
+	compileBody []token
+}
+
+func newInterp() *interp {
+	return newInterpWithMaxDepth(defaultMaxDepth)
+}
+
+// newInterpWithMaxDepth is like newInterp but lets the caller configure how deep the data
+// and return stacks are allowed to grow before push reports an overflow.
+func newInterpWithMaxDepth(maxDepth int) *interp {
+	ip := &interp{
+		stak:       stack{maxDepth: maxDepth},
+		rstak:      stack{maxDepth: maxDepth},
+		dictionary: make(map[string][]token),
+	}
 
 	// Set up a map to generalise the application of the dyadic operators.
-	fMap := make(map[tokenType]func(int, int) int)
-	fMap[tokenPlus] = func(x, y int) int { return x + y }
-	fMap[tokenMinus] = func(x, y int) int { return x - y }
-	fMap[tokenMultiply] = func(x, y int) int { return x * y }
-	fMap[tokenDivide] = func(x, y int) int { return x / y }
-
-	// Our subset of Forth recognises unsigned integers, +, -, *, /, ., and .S
-	var stak stack
-	for tok := range ch {
-		switch tok.typ {
+	ip.fMap = map[tokenType]numOp{
+		tokenPlus:     {func(x, y int) int { return x + y }, func(x, y float64) float64 { return x + y }},
+		tokenMinus:    {func(x, y int) int { return x - y }, func(x, y float64) float64 { return x - y }},
+		tokenMultiply: {func(x, y int) int { return x * y }, func(x, y float64) float64 { return x * y }},
+		tokenDivide:   {func(x, y int) int { return x / y }, func(x, y float64) float64 { return x / y }},
+	}
+	return ip
+}
+
+// truthy follows the usual Forth convention: a Bool is itself, and for numbers 0 is false,
+// anything else is true.
+func truthy(v value, at Pos) (bool, error) {
+	switch v.kind {
+	case kindBool:
+		return v.b, nil
+	case kindInt:
+		return v.i != 0, nil
+	case kindFloat:
+		return v.f != 0, nil
+	default:
+		return false, &EvalError{at, fmt.Errorf("%w: %v cannot be used as a condition", ErrTypeMismatch, v)}
+	}
+}
+
+// findMatching scans toks, starting just after the opener at index start, for the closer
+// at the same nesting depth, returning its index. Nested opener/closer pairs of the same
+// kind are skipped over. It errors if no closer is found, which means the block was left open.
+func findMatching(toks []token, start int, opener, closer tokenType) (int, error) {
+	depth := 0
+	for i := start + 1; i < len(toks); i++ {
+		switch toks[i].typ {
+		case opener:
+			depth++
+		case closer:
+			if depth == 0 {
+				return i, nil
+			}
+			depth--
+		}
+	}
+	return 0, &EvalError{toks[start].pos, ErrUnterminated}
+}
+
+// findIfElseThen is like findMatching but IF has two possible closers: ELSE and THEN.
+// It returns the index of the (depth-0) ELSE if there is one, and the index of the matching
+// THEN either way. If there is no ELSE, both indices are the THEN's index.
+func findIfElseThen(toks []token, start int) (elseIdx, thenIdx int, err error) {
+	depth := 0
+	elseIdx = -1
+	for i := start + 1; i < len(toks); i++ {
+		switch toks[i].typ {
+		case tokenIf:
+			depth++
+		case tokenElse:
+			if depth == 0 && elseIdx == -1 {
+				elseIdx = i
+			}
+		case tokenThen:
+			if depth == 0 {
+				if elseIdx == -1 {
+					elseIdx = i
+				}
+				return elseIdx, i, nil
+			}
+			depth--
+		}
+	}
+	return 0, 0, &EvalError{toks[start].pos, ErrUnterminated}
+}
+
+// run interprets a fully-formed slice of tokens: a word body, a control-flow block, or a
+// single top-level token. User-defined words and control flow re-enter run recursively,
+// with the return stack marking the nesting. It returns the first error encountered, if any.
+func (ip *interp) run(toks []token) error {
+	pc := 0
+	for pc < len(toks) {
+		t := toks[pc]
+		switch t.typ {
+		case tokenIf:
+			elseIdx, thenIdx, err := findIfElseThen(toks, pc)
+			if err != nil {
+				return err
+			}
+			cond, err := ip.stak.pop(t.pos)
+			if err != nil {
+				return err
+			}
+			isTrue, err := truthy(cond, t.pos)
+			if err != nil {
+				return err
+			}
+			if isTrue {
+				if err := ip.run(toks[pc+1 : elseIdx]); err != nil {
+					return err
+				}
+			} else if elseIdx != thenIdx {
+				if err := ip.run(toks[elseIdx+1 : thenIdx]); err != nil {
+					return err
+				}
+			}
+			pc = thenIdx
+		case tokenBegin:
+			untilIdx, err := findMatching(toks, pc, tokenBegin, tokenUntil)
+			if err != nil {
+				return err
+			}
+			body := toks[pc+1 : untilIdx]
+			for {
+				if err := ip.run(body); err != nil {
+					return err
+				}
+				cond, err := ip.stak.pop(t.pos)
+				if err != nil {
+					return err
+				}
+				done, err := truthy(cond, t.pos)
+				if err != nil {
+					return err
+				}
+				if done {
+					break
+				}
+			}
+			pc = untilIdx
+		case tokenDo:
+			loopIdx, err := findMatching(toks, pc, tokenDo, tokenLoop)
+			if err != nil {
+				return err
+			}
+			body := toks[pc+1 : loopIdx]
+			// Forth pushes "limit index DO", so index is on top of stack and pops first.
+			start, err := ip.popInt(t)
+			if err != nil {
+				return err
+			}
+			limit, err := ip.popInt(t)
+			if err != nil {
+				return err
+			}
+			for i := start; i < limit; i++ {
+				if err := ip.rstak.push(value{kind: kindInt, i: i}, t.pos); err != nil {
+					return err
+				}
+				if err := ip.run(body); err != nil {
+					return err
+				}
+				if _, err := ip.rstak.pop(t.pos); err != nil {
+					return err
+				}
+			}
+			pc = loopIdx
+		case tokenWord:
+			body, ok := ip.dictionary[t.val]
+			if !ok {
+				return &EvalError{t.pos, fmt.Errorf("%w: %s", ErrUnknownWord, t.val)}
+			}
+			if err := ip.rstak.push(value{kind: kindString, s: t.val}, t.pos); err != nil {
+				return err
+			}
+			if err := ip.run(body); err != nil {
+				return err
+			}
+			if _, err := ip.rstak.pop(t.pos); err != nil {
+				return err
+			}
+		case tokenUnknown:
+			return &EvalError{t.pos, fmt.Errorf("%w: %s", ErrUnknownWord, t.val)}
 		case tokenDot:
-			fmt.Printf("%v\n", stak.pop())
+			v, err := ip.stak.pop(t.pos)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%v\n", v)
 		case tokenPS:
-			stak.prin()
+			ip.stak.prin()
 		case tokenInt:
-			stak.push(tok)
-		case tokenUnknown:
-			fmt.Printf("Unrecognised input %v has been ignored\n", tok.val)
+			n, err := strconv.Atoi(t.val)
+			if err != nil {
+				return &EvalError{t.pos, fmt.Errorf("token maybe not integer: %v", t)}
+			}
+			if err := ip.stak.push(value{kind: kindInt, i: n}, t.pos); err != nil {
+				return err
+			}
+		case tokenFloat:
+			f, err := strconv.ParseFloat(t.val, 64)
+			if err != nil {
+				return &EvalError{t.pos, fmt.Errorf("token maybe not a float: %v", t)}
+			}
+			if err := ip.stak.push(value{kind: kindFloat, f: f}, t.pos); err != nil {
+				return err
+			}
+		case tokenString:
+			if err := ip.stak.push(value{kind: kindString, s: t.val}, t.pos); err != nil {
+				return err
+			}
+		case tokenTrue:
+			if err := ip.stak.push(value{kind: kindBool, b: true}, t.pos); err != nil {
+				return err
+			}
+		case tokenFalse:
+			if err := ip.stak.push(value{kind: kindBool, b: false}, t.pos); err != nil {
+				return err
+			}
+		case tokenEq, tokenLt, tokenGt:
+			if err := ip.compareOp(t); err != nil {
+				return err
+			}
+		case tokenAnd, tokenOr:
+			if err := ip.logicalOp(t); err != nil {
+				return err
+			}
+		case tokenNot:
+			if err := ip.notOp(t); err != nil {
+				return err
+			}
+		case tokenDup:
+			if err := ip.stak.dup(t.pos); err != nil {
+				return err
+			}
+		case tokenDrop:
+			if err := ip.stak.drop(t.pos); err != nil {
+				return err
+			}
+		case tokenSwap:
+			if err := ip.stak.swap(t.pos); err != nil {
+				return err
+			}
+		case tokenOver:
+			if err := ip.stak.over(t.pos); err != nil {
+				return err
+			}
+		case tokenRot:
+			if err := ip.stak.rot(t.pos); err != nil {
+				return err
+			}
+		case tokenI:
+			v, err := ip.loopIndex(0, t)
+			if err != nil {
+				return err
+			}
+			if err := ip.stak.push(v, t.pos); err != nil {
+				return err
+			}
+		case tokenJ:
+			v, err := ip.loopIndex(1, t)
+			if err != nil {
+				return err
+			}
+			if err := ip.stak.push(v, t.pos); err != nil {
+				return err
+			}
+		case tokenElse, tokenThen, tokenUntil, tokenLoop, tokenSemicolon, tokenColon:
+			// ELSE/THEN/UNTIL/LOOP/; only ever make sense as the closer of a block read by
+			// readBlock and resolved by findMatching/findIfElseThen; reaching run on their
+			// own means they appeared without a matching opener. tokenColon only makes
+			// sense at the top level, handled by dispatch before run ever sees it; one
+			// reaching run means it was typed inside an IF/BEGIN/DO block.
+			return &EvalError{t.pos, fmt.Errorf("%w: %s without matching opener", ErrUnexpectedToken, t.val)}
 		default:
-			t1 := stak.pop()
-			v1, err := strconv.Atoi(t1.val)
+			if err := ip.binOp(t); err != nil {
+				return err
+			}
+		}
+		pc++
+	}
+	return nil
+}
+
+// popInt pops a value that must be an Int - used for DO...LOOP bounds, which Forth always
+// counts in whole numbers.
+func (ip *interp) popInt(t token) (int, error) {
+	v, err := ip.stak.pop(t.pos)
+	if err != nil {
+		return 0, err
+	}
+	if v.kind != kindInt {
+		return 0, &EvalError{t.pos, fmt.Errorf("%w: expected Int, got %v", ErrTypeMismatch, v.kind)}
+	}
+	return v.i, nil
+}
+
+// loopIndex returns the index of an enclosing DO...LOOP: nth counts outward from the
+// innermost (I is nth=0, J is nth=1). It scans the return stack from the top, skipping the
+// string markers tokenWord pushes around a user-defined word call, since those can be
+// interleaved with loop indices if I or J is used inside a word called from a loop body.
+func (ip *interp) loopIndex(nth int, t token) (value, error) {
+	found := 0
+	for depth := 0; ; depth++ {
+		v, err := ip.rstak.peekN(depth, t.pos)
+		if err != nil {
+			return value{}, &EvalError{t.pos, fmt.Errorf("%w: not inside a DO...LOOP", ErrUnexpectedToken)}
+		}
+		if v.kind != kindInt {
+			continue
+		}
+		if found == nth {
+			return v, nil
+		}
+		found++
+	}
+}
+
+// binOp applies the dyadic operator in t (+, -, *, /) to the top two stack entries,
+// promoting to Float if either operand is a Float. For "a b OP", b is on top of stack and
+// a is below it, so the operator is applied as a OP b. Division by zero is reported
+// explicitly rather than relying on the runtime's own divide-by-zero panic.
+func (ip *interp) binOp(t token) error {
+	b, err := ip.stak.pop(t.pos)
+	if err != nil {
+		return err
+	}
+	a, err := ip.stak.pop(t.pos)
+	if err != nil {
+		return err
+	}
+	op := ip.fMap[t.typ]
+	if a.kind == kindFloat || b.kind == kindFloat {
+		fa, err := a.asFloat()
+		if err != nil {
+			return &EvalError{t.pos, err}
+		}
+		fb, err := b.asFloat()
+		if err != nil {
+			return &EvalError{t.pos, err}
+		}
+		if t.typ == tokenDivide && fb == 0 {
+			return &EvalError{t.pos, ErrDivideByZero}
+		}
+		return ip.stak.push(value{kind: kindFloat, f: op.floatOp(fa, fb)}, t.pos)
+	}
+	if a.kind != kindInt {
+		return &EvalError{t.pos, fmt.Errorf("%w: %v is not a number", ErrTypeMismatch, a)}
+	}
+	if b.kind != kindInt {
+		return &EvalError{t.pos, fmt.Errorf("%w: %v is not a number", ErrTypeMismatch, b)}
+	}
+	if t.typ == tokenDivide && b.i == 0 {
+		return &EvalError{t.pos, ErrDivideByZero}
+	}
+	return ip.stak.push(value{kind: kindInt, i: op.intOp(a.i, b.i)}, t.pos)
+}
+
+// compareOp implements =, < and >. Equality works across any pair of kinds (Int and Float
+// compare numerically, everything else only equals its own kind); ordering is numeric only.
+func (ip *interp) compareOp(t token) error {
+	v1, err := ip.stak.pop(t.pos)
+	if err != nil {
+		return err
+	}
+	v2, err := ip.stak.pop(t.pos)
+	if err != nil {
+		return err
+	}
+	var result bool
+	switch t.typ {
+	case tokenEq:
+		result, err = valuesEqual(v1, v2)
+	case tokenLt:
+		// v1 is the top of stack (b in "a b <"), v2 is below it (a); compare v2 < v1.
+		var f1, f2 float64
+		if f1, err = v1.asFloat(); err == nil {
+			f2, err = v2.asFloat()
+		}
+		result = f2 < f1
+	case tokenGt:
+		var f1, f2 float64
+		if f1, err = v1.asFloat(); err == nil {
+			f2, err = v2.asFloat()
+		}
+		result = f2 > f1
+	}
+	if err != nil {
+		return &EvalError{t.pos, err}
+	}
+	return ip.stak.push(value{kind: kindBool, b: result}, t.pos)
+}
+
+func valuesEqual(v1, v2 value) (bool, error) {
+	if v1.kind != v2.kind {
+		if (v1.kind == kindInt || v1.kind == kindFloat) && (v2.kind == kindInt || v2.kind == kindFloat) {
+			f1, err := v1.asFloat()
 			if err != nil {
-				panic(fmt.Errorf("Token maybe not integer: %v\n", t1))
+				return false, err
 			}
-			t2 := stak.pop()
-			v2, err := strconv.Atoi(t2.val)
+			f2, err := v2.asFloat()
 			if err != nil {
-				panic(fmt.Errorf("Token maybe not integer: %v\n", t2))
+				return false, err
 			}
-			rs := strconv.Itoa(fMap[tok.typ](v1, v2))
-			stak.push(token{typ: tokenInt, val: rs})
+			return f1 == f2, nil
 		}
+		return false, nil
 	}
+	switch v1.kind {
+	case kindInt:
+		return v1.i == v2.i, nil
+	case kindFloat:
+		return v1.f == v2.f, nil
+	case kindBool:
+		return v1.b == v2.b, nil
+	case kindString:
+		return v1.s == v2.s, nil
+	default:
+		return false, nil
+	}
+}
+
+// logicalOp implements "and" and "or" on two Bools.
+func (ip *interp) logicalOp(t token) error {
+	v1, err := ip.popBool(t)
+	if err != nil {
+		return err
+	}
+	v2, err := ip.popBool(t)
+	if err != nil {
+		return err
+	}
+	var result bool
+	if t.typ == tokenAnd {
+		result = v1 && v2
+	} else {
+		result = v1 || v2
+	}
+	return ip.stak.push(value{kind: kindBool, b: result}, t.pos)
+}
+
+// notOp implements "not" on a single Bool.
+func (ip *interp) notOp(t token) error {
+	v, err := ip.popBool(t)
+	if err != nil {
+		return err
+	}
+	return ip.stak.push(value{kind: kindBool, b: !v}, t.pos)
+}
+
+func (ip *interp) popBool(t token) (bool, error) {
+	v, err := ip.stak.pop(t.pos)
+	if err != nil {
+		return false, err
+	}
+	if v.kind != kindBool {
+		return false, &EvalError{t.pos, fmt.Errorf("%w: expected Bool, got %v", ErrTypeMismatch, v.kind)}
+	}
+	return v.b, nil
 }
 
-func getTokens(c chan<- token) {
+// blockCloser returns the token type that closes a block opened by typ, and whether typ
+// opens a block at all.
+func blockCloser(typ tokenType) (tokenType, bool) {
+	switch typ {
+	case tokenIf:
+		return tokenThen, true
+	case tokenBegin:
+		return tokenUntil, true
+	case tokenDo:
+		return tokenLoop, true
+	}
+	return tokenUnknown, false
+}
+
+// readBlock pulls tokens from ch, starting with first, until the matching closer for
+// first's kind has been read at depth 0. Nested blocks of the same kind are skipped over;
+// this does not need to understand other kinds of nested block, since those are only
+// resolved (by run, via findMatching/findIfElseThen) once the whole slice is in hand.
+func readBlock(ch <-chan token, first token) []token {
+	closer, _ := blockCloser(first.typ)
+	toks := []token{first}
+	depth := 0
+	for t := range ch {
+		toks = append(toks, t)
+		if t.typ == first.typ {
+			depth++
+		} else if t.typ == closer {
+			if depth == 0 {
+				break
+			}
+			depth--
+		}
+	}
+	return toks
+}
+
+// dispatch feeds one top-level token into the interpreter, handling word definitions
+// (`: name ... ;`) and control-flow blocks, which both need to read ahead on ch before
+// anything can run.
+func (ip *interp) dispatch(ch <-chan token, t token) error {
+	if ip.compiling {
+		if t.typ == tokenSemicolon {
+			ip.dictionary[ip.compileName] = ip.compileBody
+			ip.compiling = false
+			return nil
+		}
+		if t.typ == tokenColon {
+			return &EvalError{t.pos, fmt.Errorf("%w: nested : inside a word definition", ErrUnexpectedToken)}
+		}
+		ip.compileBody = append(ip.compileBody, t)
+		return nil
+	}
+	switch t.typ {
+	case tokenColon:
+		name, ok := <-ch
+		if !ok {
+			return nil
+		}
+		ip.compiling = true
+		ip.compileName = name.val
+		ip.compileBody = nil
+		return nil
+	case tokenIf, tokenBegin, tokenDo:
+		return ip.run(readBlock(ch, t))
+	default:
+		return ip.run([]token{t})
+	}
+}
+
+// resetCompileState abandons any `:` definition in progress, so that a bad definition
+// doesn't leave the interpreter wedged after Eval reports the error that caused it.
+func (ip *interp) resetCompileState() {
+	ip.compiling = false
+	ip.compileName = ""
+	ip.compileBody = nil
+}
+
+// Eval dispatches every token on toks until the channel closes or dispatch reports an
+// error. A caller embedding concat as a library can call Eval in a loop - on error, the
+// in-progress definition (if any) is discarded so the next Eval call starts clean, with
+// no recover() required anywhere in the pipeline.
+func (ip *interp) Eval(toks <-chan token) error {
+	for t := range toks {
+		if err := ip.dispatch(toks, t); err != nil {
+			ip.resetCompileState()
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	evalSrc := flag.String("e", "", "evaluate the given source and exit")
+	file := flag.String("f", "", "evaluate the given file and exit")
+	flag.Parse()
+
+	ch := make(chan token)
+	switch {
+	case *evalSrc != "":
+		go getTokens(strings.NewReader(*evalSrc), "<-e>", ch)
+	case *file != "":
+		f, err := os.Open(*file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "concat: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		go getTokens(f, *file, ch)
+	default:
+		go repl(ch)
+	}
+
+	// Our subset of Forth recognises Int, Float and String literals, true/false, the usual
+	// arithmetic and comparison operators, and/or/not, ., .S, word definitions
+	// (: name ... ;) and IF/ELSE/THEN, BEGIN/UNTIL, DO/LOOP control flow (with I/J for the
+	// loop index).
+	ip := newInterp()
+	// Eval returns as soon as one token fails; loop so a bad token doesn't end the whole
+	// session, only the statement that produced it.
+	for {
+		if err := ip.Eval(ch); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			continue
+		}
+		break
+	}
+}
+
+// getTokens scans r line by line, feeding tokens stamped with filename-qualified source
+// positions onto c. r can be stdin, a file, or a string reader - anywhere the evaluation
+// pipeline wants to pull source from.
+func getTokens(r io.Reader, filename string, c chan<- token) {
 	var lxr lexer
-	scanner := bufio.NewScanner(os.Stdin)
+	lineNo := 0
+	offset := 0
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		if err := scanner.Err(); err != nil {
-			panic(fmt.Errorf("reading standard input:%v", err))
+			panic(fmt.Errorf("reading %s: %v", filename, err))
 		}
-		lxr.init(scanner.Text())
+		lineNo++
+		line := scanner.Text()
+		lxr.init(filename, lineNo, offset, line)
 		for {
 			t := lxr.next()
 			if t.typ == tokenEOL {
@@ -231,6 +1091,96 @@ func getTokens(c chan<- token) {
 			}
 			c <- t
 		}
+		offset += len(line) + 1 // +1 for the newline the scanner stripped
 	}
 	close(c)
 }
+
+// replPrompt is shown while waiting for a fresh top-level statement; replContPrompt is
+// shown while a `:` definition or an IF/BEGIN/DO block is still open.
+const (
+	replPrompt     = "concat> "
+	replContPrompt = "...   > "
+)
+
+// depthDelta reports how much a token opens (+1) or closes (-1) the nesting that the REPL
+// front-end needs to track to know when a multi-line definition or control-flow block is
+// complete. It mirrors the opener/closer pairs that run and dispatch already understand.
+func depthDelta(t token) int {
+	switch t.typ {
+	case tokenColon, tokenIf, tokenBegin, tokenDo:
+		return 1
+	case tokenSemicolon, tokenThen, tokenUntil, tokenLoop:
+		return -1
+	default:
+		return 0
+	}
+}
+
+// repl drives an interactive front-end on c: persistent history, arrow-key recall, and a
+// continuation prompt that keeps reading lines until an open `:` definition or control-flow
+// block is closed. Ctrl-C abandons whatever is partially typed and returns to the top-level
+// prompt instead of exiting; Ctrl-D (or EOF) ends the session.
+func repl(c chan<- token) {
+	line := liner.NewLiner()
+	defer line.Close()
+	line.SetCtrlCAborts(true)
+
+	if f, err := os.Open(historyFile()); err == nil {
+		line.ReadHistory(f)
+		f.Close()
+	}
+	defer func() {
+		if f, err := os.Create(historyFile()); err == nil {
+			line.WriteHistory(f)
+			f.Close()
+		}
+	}()
+
+	var lxr lexer
+	lineNo, offset, depth := 0, 0, 0
+	var pending []token
+	prompt := replPrompt
+	for {
+		text, err := line.Prompt(prompt)
+		switch err {
+		case nil:
+		case liner.ErrPromptAborted: // Ctrl-C: discard whatever was being typed
+			pending, depth, prompt = nil, 0, replPrompt
+			continue
+		default: // EOF (Ctrl-D) or a read error: end the session
+			close(c)
+			return
+		}
+		line.AppendHistory(text)
+
+		lineNo++
+		lxr.init("<stdin>", lineNo, offset, text)
+		offset += len(text) + 1
+		for {
+			t := lxr.next()
+			if t.typ == tokenEOL {
+				break
+			}
+			depth += depthDelta(t)
+			pending = append(pending, t)
+		}
+
+		if depth <= 0 {
+			for _, t := range pending {
+				c <- t
+			}
+			pending, depth, prompt = nil, 0, replPrompt
+		} else {
+			prompt = replContPrompt
+		}
+	}
+}
+
+func historyFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".concat_history"
+	}
+	return filepath.Join(home, ".concat_history")
+}
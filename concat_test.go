@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// evalSrc feeds src through the same getTokens -> Eval pipeline main uses, returning the
+// error (if any) Eval reported.
+func evalSrc(ip *interp, src string) error {
+	ch := make(chan token)
+	go getTokens(strings.NewReader(src), "<test>", ch)
+	return ip.Eval(ch)
+}
+
+// TestEvalErrors pins the sentinel error each failure mode reports, so a regression in any
+// of them (e.g. a nil-pointer panic instead of an EvalError) fails loudly instead of being
+// caught only by chance.
+func TestEvalErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want error
+	}{
+		{"stack underflow", "1 +", ErrStackUnderflow},
+		{"stack overflow", "", ErrStackOverflow}, // filled in below
+		{"divide by zero", "1 0 /", ErrDivideByZero},
+		{"unknown word", "nosuchword", ErrUnknownWord},
+		{"type mismatch", "1 true +", ErrTypeMismatch},
+		{"unterminated if", "true IF 1", ErrUnterminated},
+		{"unterminated begin", "BEGIN 1", ErrUnterminated},
+		{"unterminated do", "1 0 DO 1", ErrUnterminated},
+		{"stray then", "1 2 THEN", ErrUnexpectedToken},
+		{"stray else", "1 2 ELSE", ErrUnexpectedToken},
+		{"stray until", "1 2 UNTIL", ErrUnexpectedToken},
+		{"stray loop", "1 2 LOOP", ErrUnexpectedToken},
+		{"stray semicolon", "1 2 ;", ErrUnexpectedToken},
+		{"stray colon in block", "true IF : foo ; THEN", ErrUnexpectedToken},
+		{"nested colon", "1 : foo : bar 1 ; ;", ErrUnexpectedToken},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ip := newInterpWithMaxDepth(defaultMaxDepth)
+			src := tc.src
+			if tc.name == "stack overflow" {
+				ip = newInterpWithMaxDepth(1)
+				src = "1 2"
+			}
+			err := evalSrc(ip, src)
+			if err == nil {
+				t.Fatalf("evalSrc(%q) = nil, want error wrapping %v", src, tc.want)
+			}
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("evalSrc(%q) = %v, want error wrapping %v", src, err, tc.want)
+			}
+		})
+	}
+}
+
+// TestCompareAndArithmetic pins the operand order and promotion rules for the dyadic
+// operators: "a b OP" must evaluate as "a OP b", not "b OP a".
+func TestCompareAndArithmetic(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want value
+	}{
+		{"greater true", "5 1 >", value{kind: kindBool, b: true}},
+		{"greater false", "1 5 >", value{kind: kindBool, b: false}},
+		{"less true", "1 5 <", value{kind: kindBool, b: true}},
+		{"less false", "5 1 <", value{kind: kindBool, b: false}},
+		{"subtraction order", "5 2 -", value{kind: kindInt, i: 3}},
+		{"division order", "10 2 /", value{kind: kindInt, i: 5}},
+		{"float promotion", "1 2.5 +", value{kind: kindFloat, f: 3.5}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ip := newInterp()
+			if err := evalSrc(ip, tc.src); err != nil {
+				t.Fatalf("evalSrc(%q): %v", tc.src, err)
+			}
+			got, err := ip.stak.peek(Pos{})
+			if err != nil {
+				t.Fatalf("stack empty after %q: %v", tc.src, err)
+			}
+			if got != tc.want {
+				t.Fatalf("evalSrc(%q): stack top = %+v, want %+v", tc.src, got, tc.want)
+			}
+		})
+	}
+}
+
+// BenchmarkArithmeticLoop exercises the stack's push/pop path the way a tight arithmetic
+// word would: two pushes, an add, a pop, repeated. With the old fixed-array stack this
+// scanned up to stackSize frames on every push; the slice-backed stack is O(1).
+func BenchmarkArithmeticLoop(b *testing.B) {
+	ip := newInterp()
+	toks := []token{
+		{typ: tokenInt, val: "1"},
+		{typ: tokenInt, val: "2"},
+		{typ: tokenPlus},
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := ip.run(toks); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := ip.stak.pop(Pos{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}